@@ -14,19 +14,34 @@
 package main
 
 import (
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
-	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/pkg/errors"
-	"github.com/satori/go.uuid"
 	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/mendersoftware/deviceauth/model"
 )
 
 var (
 	ErrTokenExpired = errors.New("jwt: token expired")
 	ErrTokenInvalid = errors.New("jwt: token ivalid")
+	ErrTokenRevoked = errors.New("jwt: token revoked")
 )
 
 // Token field names
@@ -42,98 +57,857 @@ const (
 	ErrMsgPrivKeyReadFailed    = "failed to read server private key file"
 	ErrMsgPrivKeyNotPEMEncoded = "server private key not PEM-encoded"
 	ErrMsgCreateTokenFailed    = "failed to create token"
+	ErrMsgUnknownSigningKey    = "unknown signing key"
+	ErrMsgAlgMismatch          = "token alg does not match signing key"
 )
 
+// JWKSUri is where the public half of the tenant's signing keys is
+// published, so that other Mender services can validate deviceauth-issued
+// tokens without needing to share the private PEM file out of band.
+const JWKSUri = "/api/internal/v1/devauth/.well-known/jwks.json"
+
+// keyCacheTTL bounds how long a SigningKey fetched from the KeyStore is
+// trusted before it's re-fetched. It's what makes key rotation and
+// revocation actually take effect for tokens already in flight, instead
+// of only applying to processes restarted after the change.
+const keyCacheTTL = 5 * time.Minute
+
+// Algorithm is one of the JWS signing algorithms a SigningKey can use.
+// It mirrors jose.SignatureAlgorithm but keeps the set deviceauth
+// actually supports explicit and documented in one place.
+type Algorithm string
+
+const (
+	RS256 Algorithm = "RS256"
+	RS384 Algorithm = "RS384"
+	PS256 Algorithm = "PS256"
+	ES256 Algorithm = "ES256"
+	EdDSA Algorithm = "EdDSA"
+)
+
+func (a Algorithm) joseAlg() jose.SignatureAlgorithm {
+	return jose.SignatureAlgorithm(a)
+}
+
 type JWTAgentConfig struct {
-	// path to server private key
+	// path to server private key; only used when the agent is built
+	// around a StaticKeyStore (see NewJWTAgent)
 	ServerPrivKeyPath string
-	// expiration timeout in seconds
+	// signing algorithm to use with the server private key; defaults to
+	// RS256 when empty, for compatibility with existing deployments
+	Algorithm Algorithm
+	// expiration timeout in seconds for access tokens
 	ExpirationTimeout int64
+	// expiration timeout in seconds for refresh tokens; defaults to
+	// 24x ExpirationTimeout when zero, so refresh tokens comfortably
+	// outlive the access tokens issued against them
+	RefreshExpirationTimeout int64
 	// token issuer
 	Issuer string
 }
 
+// defaultRefreshTimeoutMultiple is applied to ExpirationTimeout to derive
+// RefreshExpirationTimeout when it isn't set explicitly.
+const defaultRefreshTimeoutMultiple = 24
+
+// KeyStore is where a JWTAgent gets the keys it signs and verifies
+// tokens with. The MongoDB-backed implementation in store/mongo keeps
+// one active key per tenant plus the retired keys still needed to
+// validate outstanding tokens; StaticKeyStore is a single-key,
+// tenant-agnostic implementation for simple deployments.
+type KeyStore interface {
+	GetActiveSigningKey(ctx context.Context) (*model.Key, error)
+	GetVerificationKey(ctx context.Context, kid string) (*model.Key, error)
+	GetAllVerificationKeys(ctx context.Context) ([]*model.Key, error)
+	RotateSigningKey(ctx context.Context, key *model.Key) error
+}
+
+// RevocationStore lets a JWTAgent blacklist tokens by jti (or an entire
+// device's tokens at once) ahead of their natural expiry, e.g. because a
+// device was decommissioned or a specific token was confirmed stolen.
+// It's optional: a JWTAgent built without one (nil) behaves as before
+// and tokens are only ever invalidated by expiry.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, jti, deviceId string, exp time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	RevokeDeviceTokens(ctx context.Context, deviceId string, exp time.Time) error
+	IsDeviceRevoked(ctx context.Context, deviceId string) (bool, error)
+}
+
 type JWTAgent struct {
-	privKey    *rsa.PrivateKey
-	issuer     string
-	expTimeout int64
+	keys              KeyStore
+	revocation        RevocationStore
+	issuer            string
+	expTimeout        int64
+	refreshExpTimeout int64
+	cache             *keyCache
+	refreshSeen       *refreshTokenLRU
 }
 
 type JWTAgentApp interface {
-	GenerateTokenSignRS256(devId string) (*Token, error)
-	ValidateTokenSignRS256(token string) (string, error)
+	GenerateToken(ctx context.Context, devId string) (*Token, error)
+	ValidateToken(ctx context.Context, token string) (string, error)
+	RevokeToken(ctx context.Context, jti string) error
+}
+
+// token typ claim values. Carrying the type in the token itself is what
+// stops a refresh token from being replayed as an access token (or vice
+// versa) even though both are signed by the same key.
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+// customClaims adds deviceauth's own typ claim on top of the standard
+// JWT claim set.
+type customClaims struct {
+	jwt.Claims
+	Type string `json:"typ"`
+}
+
+// TokenPair is the result of GenerateTokenPair/RefreshToken: a
+// short-lived access token for authenticating requests, and a
+// longer-lived refresh token used only to obtain a new pair.
+type TokenPair struct {
+	Token        *Token
+	RefreshToken *Token
+}
+
+// SigningKey is a key pair parsed and ready for signing or verifying a
+// token. Private is a crypto.Signer so the same type covers RSA, ECDSA
+// and Ed25519 keys; it's nil for a verification-only key, in which case
+// pub holds the public key instead.
+type SigningKey struct {
+	Kid     string
+	Alg     Algorithm
+	Private crypto.Signer
+	pub     crypto.PublicKey
+	// NotAfter is the point past which this key is no longer trusted to
+	// verify a token, even if the token's own exp hasn't been reached
+	// yet - the zero value means the key has no such boundary (it's
+	// still active, or was never subject to rotation).
+	NotAfter time.Time
+}
+
+func (k *SigningKey) Public() crypto.PublicKey {
+	if k.Private != nil {
+		return k.Private.Public()
+	}
+	return k.pub
+}
+
+// cachedKey is a SigningKey together with the time it should be evicted
+// from the keyCache and re-fetched from the KeyStore.
+type cachedKey struct {
+	key     *SigningKey
+	expires time.Time
+}
+
+func (c cachedKey) expired() bool {
+	return time.Now().After(c.expires)
+}
+
+// keyCache memoizes SigningKeys parsed from the KeyStore, both by
+// (tenant, kid) (for verification) and by tenant (for the currently
+// active signing key), so that signing or validating a token doesn't hit
+// the KeyStore on every request. byKid is scoped per tenant, not just by
+// kid: GetVerificationKey is itself tenant-scoped (it only ever looks in
+// the caller's own per-tenant database), and a kid is merely an
+// admin-supplied/thumbprint-derived label, not a value any tenant is
+// prevented from colliding with - without per-tenant scoping here, one
+// tenant registering a key under another tenant's kid (discoverable via
+// the public JWKS endpoint) would poison the shared cache entry for that
+// kid. A background janitor evicts stale entries once their TTL elapses,
+// which is what makes a rotated-out or revoked key stop being trusted
+// within one TTL window even if nothing ever looks it up again in the
+// meantime.
+type keyCache struct {
+	mu     sync.Mutex
+	byKid  map[string]cachedKey // keyed by tenant+"\x00"+kid
+	active map[string]cachedKey // keyed by tenant
+	ttl    time.Duration
+	stop   chan struct{}
+}
+
+func newKeyCache(ttl time.Duration) *keyCache {
+	c := &keyCache{
+		byKid:  map[string]cachedKey{},
+		active: map[string]cachedKey{},
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+	}
+	go c.janitor()
+	return c
+}
+
+// byKidKey scopes a kid lookup/store to a single tenant's namespace.
+func byKidKey(tenant, kid string) string {
+	return tenant + "\x00" + kid
+}
+
+func (c *keyCache) janitor() {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.evictExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background janitor. It must be called once the
+// JWTAgent owning this cache is no longer needed, or the janitor
+// goroutine leaks for the life of the process.
+func (c *keyCache) Close() {
+	close(c.stop)
+}
+
+func (c *keyCache) evictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.byKid {
+		if v.expired() {
+			delete(c.byKid, k)
+		}
+	}
+	for k, v := range c.active {
+		if v.expired() {
+			delete(c.active, k)
+		}
+	}
+}
+
+func (c *keyCache) getByKid(tenant, kid string) (*SigningKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ck, ok := c.byKid[byKidKey(tenant, kid)]
+	if !ok || ck.expired() {
+		return nil, false
+	}
+	return ck.key, true
+}
+
+func (c *keyCache) putByKid(tenant string, key *SigningKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byKid[byKidKey(tenant, key.Kid)] = cachedKey{key: key, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *keyCache) getActive(tenant string) (*SigningKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ck, ok := c.active[tenant]
+	if !ok || ck.expired() {
+		return nil, false
+	}
+	return ck.key, true
+}
+
+func (c *keyCache) putActive(tenant string, key *SigningKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active[tenant] = cachedKey{key: key, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidateActive drops any cached active key for tenant, so that a
+// freshly rotated key takes effect immediately instead of waiting out
+// the TTL.
+func (c *keyCache) invalidateActive(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.active, tenant)
+}
+
+// NewJWTAgentWithKeyStore builds a JWTAgent around an arbitrary KeyStore,
+// e.g. the MongoDB-backed per-tenant store in store/mongo. revocation may
+// be nil, in which case RevokeToken/RevokeDeviceTokens fail, and rotated
+// refresh tokens are only checked for replay against an in-process LRU
+// rather than a durable store.
+func NewJWTAgentWithKeyStore(keys KeyStore, revocation RevocationStore, issuer string, expTimeout, refreshExpTimeout int64) *JWTAgent {
+	if refreshExpTimeout == 0 {
+		refreshExpTimeout = expTimeout * defaultRefreshTimeoutMultiple
+	}
+	return &JWTAgent{
+		keys:              keys,
+		revocation:        revocation,
+		issuer:            issuer,
+		expTimeout:        expTimeout,
+		refreshExpTimeout: refreshExpTimeout,
+		cache:             newKeyCache(keyCacheTTL),
+		refreshSeen:       newRefreshTokenLRU(defaultRefreshLRUCapacity),
+	}
+}
+
+// Close stops the agent's background key-cache janitor. It must be
+// called once a JWTAgent is no longer needed, or that goroutine leaks
+// for the life of the process.
+func (j *JWTAgent) Close() {
+	j.cache.Close()
 }
 
-// Generates JWT token signed using RS256
-func (j *JWTAgent) GenerateTokenSignRS256(devId string) (*Token, error) {
+// generateTypedToken signs a token of the given typ (access or refresh)
+// for devId, valid for ttlSeconds, with the caller's tenant's active key.
+func (j *JWTAgent) generateTypedToken(ctx context.Context, devId, typ string, ttlSeconds int64) (*Token, error) {
+	tenant := identity.FromContext(ctx).Tenant
+
+	key, ok := j.cache.getActive(tenant)
+	if !ok {
+		mk, err := j.keys.GetActiveSigningKey(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrMsgCreateTokenFailed)
+		}
+		key, err = signingKeyFromModel(mk)
+		if err != nil {
+			return nil, errors.Wrap(err, ErrMsgCreateTokenFailed)
+		}
+		j.cache.putActive(tenant, key)
+		j.cache.putByKid(tenant, key)
+	}
+
 	// Generate token ID
 	jti := generateTokenId()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: key.Alg.joseAlg(), Key: key.Private},
+		(&jose.SignerOptions{}).WithHeader("kid", key.Kid))
+	if err != nil {
+		return nil, errors.Wrap(err, ErrMsgCreateTokenFailed)
+	}
+
 	// Set claims
-	claims := jwt.StandardClaims{
-		Issuer:    j.issuer,
-		ExpiresAt: time.Now().Unix() + j.expTimeout,
-		Subject:   devId,
-		Id:        jti,
+	claims := customClaims{
+		Claims: jwt.Claims{
+			Issuer:  j.issuer,
+			Expiry:  jwt.NewNumericDate(time.Now().Add(time.Duration(ttlSeconds) * time.Second)),
+			Subject: devId,
+			ID:      jti,
+		},
+		Type: typ,
 	}
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	// Sign and get the complete encoded token as a string
-	tokenString, err := token.SignedString(j.privKey)
+
+	// Create and sign the token
+	tokenString, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
 	if err != nil {
 		return nil, errors.Wrap(err, ErrMsgCreateTokenFailed)
 	}
 	return NewToken(jti, devId, tokenString), nil
 }
 
-// Validates token.
-// Returns jti and nil if token is valid or "" and error otherwise
-func (j *JWTAgent) ValidateTokenSignRS256(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, errors.New("Unexpected signing method: " + token.Method.Alg())
+// Generates a short-lived access JWT token signed with the caller's
+// tenant's active key.
+func (j *JWTAgent) GenerateToken(ctx context.Context, devId string) (*Token, error) {
+	return j.generateTypedToken(ctx, devId, tokenTypeAccess, j.expTimeout)
+}
+
+// GenerateTokenPair issues a fresh access token together with the
+// longer-lived refresh token used to renew it, so a device never needs
+// to present the long-lived credential itself except to refresh.
+func (j *JWTAgent) GenerateTokenPair(ctx context.Context, devId string) (*TokenPair, error) {
+	access, err := j.generateTypedToken(ctx, devId, tokenTypeAccess, j.expTimeout)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := j.generateTypedToken(ctx, devId, tokenTypeRefresh, j.refreshExpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Token: access, RefreshToken: refresh}, nil
+}
+
+// validateTypedToken parses and verifies tokenString exactly like
+// ValidateToken, but additionally requires its typ claim to equal
+// wantType - this is what prevents a refresh token from being accepted
+// as an access token or the other way around.
+func (j *JWTAgent) validateTypedToken(ctx context.Context, tokenString, wantType string) (jti, devId string, err error) {
+	token, err := jwt.ParseSigned(tokenString)
+	if err != nil {
+		return "", "", errors.Wrap(err, "token invalid")
+	}
+
+	if len(token.Headers) == 0 || token.Headers[0].KeyID == "" {
+		return "", "", errors.New("token invalid: missing kid")
+	}
+	kid := token.Headers[0].KeyID
+	tenant := identity.FromContext(ctx).Tenant
+
+	key, ok := j.cache.getByKid(tenant, kid)
+	if !ok {
+		mk, err := j.keys.GetVerificationKey(ctx, kid)
+		if err != nil {
+			return "", "", errors.Wrap(err, "token invalid")
+		}
+		key, err = signingKeyFromModel(mk)
+		if err != nil {
+			return "", "", errors.Wrap(err, "token invalid")
+		}
+		j.cache.putByKid(tenant, key)
+	}
+
+	if Algorithm(token.Headers[0].Algorithm) != key.Alg {
+		return "", "", errors.New(ErrMsgAlgMismatch)
+	}
+
+	if !key.NotAfter.IsZero() && time.Now().After(key.NotAfter) {
+		return "", "", errors.New("token invalid: signing key retired")
+	}
+
+	var claims customClaims
+	if err := token.Claims(key.Public(), &claims); err != nil {
+		return "", "", errors.Wrap(err, "token invalid")
+	}
+
+	if err := claims.Claims.Validate(jwt.Expected{Issuer: j.issuer, Time: time.Now()}); err != nil {
+		if err == jwt.ErrExpired {
+			return "", "", ErrTokenExpired
+		}
+		return "", "", errors.Wrap(err, "token invalid")
+	}
+
+	if claims.Type != wantType {
+		return "", "", errors.New("token invalid: unexpected token type")
+	}
+
+	if j.revocation != nil {
+		revoked, err := j.revocation.IsTokenRevoked(ctx, claims.Claims.ID)
+		if err != nil {
+			return "", "", errors.Wrap(err, "token invalid")
+		}
+		if revoked {
+			return "", "", ErrTokenRevoked
+		}
+
+		deviceRevoked, err := j.revocation.IsDeviceRevoked(ctx, claims.Claims.Subject)
+		if err != nil {
+			return "", "", errors.Wrap(err, "token invalid")
+		}
+		if deviceRevoked {
+			return "", "", ErrTokenRevoked
 		}
-		// TODO:
-		// do we need different keys for different tokens (groups, tenants)?
-		// if yes, keys will be stored in database not in files
-		// and API for placing keys in database will be needed
-		return &j.privKey.PublicKey, nil
-	})
+	}
+
+	return claims.Claims.ID, claims.Claims.Subject, nil
+}
+
+// Validates an access token.
+// Returns jti and nil if token is valid or "" and error otherwise
+func (j *JWTAgent) ValidateToken(ctx context.Context, tokenString string) (string, error) {
+	jti, _, err := j.validateTypedToken(ctx, tokenString, tokenTypeAccess)
+	return jti, err
+}
+
+// RefreshToken trades in a refresh token for a freshly rotated
+// access/refresh pair. The presented refresh token's jti is recorded as
+// used (via the RevocationStore if one is configured, otherwise via an
+// in-process LRU) so that presenting the same refresh token twice is
+// rejected as a replay - a strong signal the token was stolen.
+func (j *JWTAgent) RefreshToken(ctx context.Context, refreshTokenString string) (*Token, *Token, error) {
+	jti, devId, err := j.validateTypedToken(ctx, refreshTokenString, tokenTypeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	replayed, err := j.checkAndMarkRefreshUsed(ctx, jti, devId)
 	if err != nil {
-		if vErr, ok := err.(*jwt.ValidationError); ok {
-			if (vErr.Errors & jwt.ValidationErrorExpired) != 0 {
-				return "", ErrTokenExpired
-			}
+		return nil, nil, err
+	}
+	if replayed {
+		return nil, nil, ErrTokenRevoked
+	}
+
+	access, err := j.generateTypedToken(ctx, devId, tokenTypeAccess, j.expTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := j.generateTypedToken(ctx, devId, tokenTypeRefresh, j.refreshExpTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// alreadyRevokedError is implemented by the error a RevocationStore's
+// RevokeToken returns when jti was already on record, so callers that
+// care (checkAndMarkRefreshUsed) can tell "already revoked" apart from
+// any other failure to write the record.
+type alreadyRevokedError interface {
+	AlreadyRevoked() bool
+}
+
+// checkAndMarkRefreshUsed reports whether jti was already spent, and
+// records it as spent otherwise. With a RevocationStore configured,
+// this is a single atomic RevokeToken call rather than a check followed
+// by a separate write: two concurrent callers replaying the same jti
+// both racing a read-then-write would otherwise both observe "not yet
+// revoked" and get issued a fresh pair each, defeating replay detection
+// entirely. The store is expected to make the write itself atomic (a
+// unique index in the Mongo-backed implementation) and report a
+// pre-existing record via alreadyRevokedError rather than a plain write
+// failure.
+func (j *JWTAgent) checkAndMarkRefreshUsed(ctx context.Context, jti, devId string) (bool, error) {
+	if j.revocation != nil {
+		exp := time.Now().Add(time.Duration(j.refreshExpTimeout) * time.Second)
+		err := j.revocation.RevokeToken(ctx, jti, devId, exp)
+		if err == nil {
+			return false, nil
+		}
+		if are, ok := err.(alreadyRevokedError); ok && are.AlreadyRevoked() {
+			return true, nil
 		}
-		return "", errors.Wrap(err, "token invalid")
+		return false, errors.Wrap(err, "failed to record spent refresh token")
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if jtiStr, ok := claims[jwtIdClaim].(string); ok {
-			return jtiStr, nil
+	return j.refreshSeen.checkAndMark(jti), nil
+}
+
+// defaultRefreshLRUCapacity bounds the in-process replay cache used when
+// no RevocationStore is configured.
+const defaultRefreshLRUCapacity = 10000
+
+// refreshTokenLRU is a fallback replay cache for rotated refresh token
+// jtis, used only when no RevocationStore is configured. It's bounded
+// and per-process - a restart forgets it - so it's weaker than the
+// Mongo-backed store, but still catches naive replay within a process's
+// lifetime.
+type refreshTokenLRU struct {
+	mu    sync.Mutex
+	cap   int
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+func newRefreshTokenLRU(capacity int) *refreshTokenLRU {
+	return &refreshTokenLRU{
+		cap:   capacity,
+		order: list.New(),
+		seen:  map[string]*list.Element{},
+	}
+}
+
+// checkAndMark reports whether jti had already been marked (a replay),
+// and marks it seen if not.
+func (l *refreshTokenLRU) checkAndMark(jti string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.seen[jti]; ok {
+		l.order.MoveToFront(el)
+		return true
+	}
+
+	l.seen[jti] = l.order.PushFront(jti)
+
+	for l.order.Len() > l.cap {
+		oldest := l.order.Back()
+		if oldest == nil {
+			break
 		}
+		l.order.Remove(oldest)
+		delete(l.seen, oldest.Value.(string))
 	}
-	return "", errors.New("Token invalid")
+
+	return false
 }
 
-func getRSAPrivKey(privKeyPath string) (*rsa.PrivateKey, error) {
-	// read key from file
-	pemData, err := ioutil.ReadFile(privKeyPath)
+// RevokeToken blacklists jti so any future ValidateToken call for it
+// fails with ErrTokenRevoked, even though the token's signature and
+// expiry are still otherwise valid. The revocation record's TTL is set
+// to now+refreshExpTimeout: since a jti being revoked now must have been issued
+// in the past, that's always at least as far out as the token's own
+// expiry, so the record outlives the token without needing to know its
+// real exp.
+func (j *JWTAgent) RevokeToken(ctx context.Context, jti string) error {
+	if j.revocation == nil {
+		return errors.New("no revocation store configured")
+	}
+	// jti may belong to either an access or a refresh token, and we have
+	// no way to tell which from the jti alone - use refreshExpTimeout,
+	// the longer of the two, so the revocation record always outlives
+	// whichever kind of token it is (refreshExpTimeout >= expTimeout).
+	exp := time.Now().Add(time.Duration(j.refreshExpTimeout) * time.Second)
+	err := j.revocation.RevokeToken(ctx, jti, "", exp)
+	if are, ok := err.(alreadyRevokedError); ok && are.AlreadyRevoked() {
+		// jti was already revoked (e.g. a refresh caught as a replay,
+		// or this same admin call retried) - that's the desired end
+		// state, not a failure.
+		return nil
+	}
+	return err
+}
+
+// RevokeDeviceTokens blacklists every token currently issued to
+// deviceId, for use when a device is decommissioned or rejected - until
+// now, that only stopped new tokens from being issued, while any token
+// already handed out kept validating until it expired on its own.
+func (j *JWTAgent) RevokeDeviceTokens(ctx context.Context, deviceId string) error {
+	if j.revocation == nil {
+		return errors.New("no revocation store configured")
+	}
+	// See RevokeToken: use refreshExpTimeout so the device-wide
+	// revocation outlives any refresh token the device may be holding,
+	// not just its (shorter-lived) access tokens.
+	exp := time.Now().Add(time.Duration(j.refreshExpTimeout) * time.Second)
+	return j.revocation.RevokeDeviceTokens(ctx, deviceId, exp)
+}
+
+// RevokeTokenHandler handles POST /tokens/{jti}/revoke.
+func (j *JWTAgent) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	jti := pathParam(r.URL.Path, 1)
+	if jti == "" {
+		http.Error(w, "invalid request path", http.StatusBadRequest)
+		return
+	}
+	if err := j.RevokeToken(r.Context(), jti); err != nil {
+		http.Error(w, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeDeviceTokensHandler handles POST /devices/{id}/tokens/revoke.
+func (j *JWTAgent) RevokeDeviceTokensHandler(w http.ResponseWriter, r *http.Request) {
+	deviceId := pathParam(r.URL.Path, 1)
+	if deviceId == "" {
+		http.Error(w, "invalid request path", http.StatusBadRequest)
+		return
+	}
+	if err := j.RevokeDeviceTokens(r.Context(), deviceId); err != nil {
+		http.Error(w, "failed to revoke device tokens", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pathParam pulls the i-th "/"-separated segment out of a URL path, e.g.
+// pathParam("/devices/42/tokens/revoke", 1) == "42". Used instead of
+// depending on a specific router's path-param extraction.
+func pathParam(urlPath string, i int) string {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if i < 0 || i >= len(parts) {
+		return ""
+	}
+	return parts[i]
+}
+
+// RotateSigningKey installs newKey as the caller's tenant's active
+// signing key. The previously active key is kept on record by the
+// KeyStore (marked inactive, not deleted) so that tokens it already
+// signed keep validating until they expire naturally.
+func (j *JWTAgent) RotateSigningKey(ctx context.Context, newKey *model.Key) error {
+	if err := j.keys.RotateSigningKey(ctx, newKey); err != nil {
+		return errors.Wrap(err, "failed to rotate signing key")
+	}
+	j.cache.invalidateActive(identity.FromContext(ctx).Tenant)
+	return nil
+}
+
+// validAlgorithms is the set of Algorithm values RotateSigningKeyHandler
+// accepts for an admin-supplied key.
+var validAlgorithms = map[Algorithm]bool{
+	RS256: true,
+	RS384: true,
+	PS256: true,
+	ES256: true,
+	EdDSA: true,
+}
+
+// algMatchesKeyType reports whether alg is a sound pairing for signer's
+// concrete key type (e.g. ES256 paired with an RSA key is not) - left
+// unchecked, that mismatch is only discovered the next time GenerateToken
+// tries to build a jose.Signer with it, silently breaking token issuance
+// for the tenant until someone notices and rotates again.
+func algMatchesKeyType(alg Algorithm, signer crypto.Signer) bool {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return alg == RS256 || alg == RS384 || alg == PS256
+	case *ecdsa.PublicKey:
+		return alg == ES256
+	case ed25519.PublicKey:
+		return alg == EdDSA
+	default:
+		return false
+	}
+}
+
+// rotateSigningKeyRequest is the JSON body RotateSigningKeyHandler
+// expects. model.Key.PrivatePEM is tagged json:"-" so that nothing that
+// JSON-encodes a model.Key (there is none today, but JWKSHandler is
+// proof such a thing is expected to exist) ever echoes private key
+// material back out; this is the one place something needs to read it
+// in instead, hence the separate request type.
+type rotateSigningKeyRequest struct {
+	Alg        string `json:"alg"`
+	PrivatePEM string `json:"private_pem"`
+}
+
+// RotateSigningKeyHandler lets an admin push in a new active signing key
+// for the caller's tenant. Kid is always re-derived from private_pem's
+// own thumbprint and any client-supplied Kid is ignored, so the kid a
+// token carries always identifies the key material that signed it.
+// Alg must be one of the supported
+// Algorithms and must actually match private_pem's key type.
+func (j *JWTAgent) RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req rotateSigningKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	alg := Algorithm(req.Alg)
+	if !validAlgorithms[alg] {
+		http.Error(w, "unsupported alg", http.StatusBadRequest)
+		return
+	}
+
+	signer, err := parsePrivateKeyPEM([]byte(req.PrivatePEM))
 	if err != nil {
-		return nil, errors.Wrap(err, ErrMsgPrivKeyReadFailed)
+		http.Error(w, "invalid private_pem", http.StatusBadRequest)
+		return
+	}
+	if !algMatchesKeyType(alg, signer) {
+		http.Error(w, "alg does not match private_pem key type", http.StatusBadRequest)
+		return
+	}
+
+	kid, err := keyThumbprint(signer.Public())
+	if err != nil {
+		http.Error(w, "failed to derive kid", http.StatusInternalServerError)
+		return
+	}
+
+	key := model.Key{Kid: kid, Alg: req.Alg, PrivatePEM: req.PrivatePEM}
+	if err := j.RotateSigningKey(r.Context(), &key); err != nil {
+		http.Error(w, "failed to rotate signing key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AuthRefreshUri is the device-facing endpoint used to trade a refresh
+// token in for a freshly rotated access/refresh token pair.
+const AuthRefreshUri = "/auth_refresh"
+
+type authRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthRefreshHandler handles POST /auth_refresh.
+func (j *JWTAgent) AuthRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req authRefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	access, refresh, err := j.RefreshToken(r.Context(), req.RefreshToken)
+	if err != nil {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&TokenPair{Token: access, RefreshToken: refresh})
+}
+
+// JWKSHandler serves the public half of the caller's tenant's signing
+// keys as a JWKS document (RFC 7517), so that other Mender services can
+// validate deviceauth-issued tokens without needing the private PEM.
+func (j *JWTAgent) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	mks, err := j.keys.GetAllVerificationKeys(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+
+	jwks := &jose.JSONWebKeySet{}
+	for _, mk := range mks {
+		key, err := signingKeyFromModel(mk)
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       key.Public(),
+			KeyID:     key.Kid,
+			Algorithm: string(key.Alg),
+			Use:       "sig",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
+}
+
+// signingKeyFromModel turns a model.Key loaded from a KeyStore into a
+// ready-to-use SigningKey, parsing its PEM-encoded key material. A key
+// with no private_pem (e.g. an old, inactive key some stores may choose
+// not to keep the private half of) is usable for verification only.
+func signingKeyFromModel(mk *model.Key) (*SigningKey, error) {
+	if mk.PrivatePEM != "" {
+		signer, err := parsePrivateKeyPEM([]byte(mk.PrivatePEM))
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{Kid: mk.Kid, Alg: Algorithm(mk.Alg), Private: signer, NotAfter: mk.NotAfter}, nil
+	}
+
+	pub, err := parsePublicKeyPEM([]byte(mk.PublicPEM))
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Kid: mk.Kid, Alg: Algorithm(mk.Alg), pub: pub, NotAfter: mk.NotAfter}, nil
+}
+
+// parsePrivateKeyPEM loads a crypto.Signer from PEM-encoded key bytes.
+// The PEM block type determines how the bytes are parsed:
+//   - "RSA PRIVATE KEY"  -> PKCS#1 RSA key, used with RS256/RS384/PS256
+//   - "EC PRIVATE KEY"   -> SEC1 EC key, used with ES256
+//   - "PRIVATE KEY"      -> PKCS#8 key, used for Ed25519 (EdDSA)
+func parsePrivateKeyPEM(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New(ErrMsgPrivKeyNotPEMEncoded)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("server private key of type %T is not usable for signing", key)
+		}
+		return signer, nil
+	default:
+		return nil, errors.Errorf("unknown server private key type: %s", block.Type)
 	}
-	// decode pem key
+}
+
+// parsePublicKeyPEM loads a crypto.PublicKey from a PEM-encoded
+// "PUBLIC KEY" (PKIX/SubjectPublicKeyInfo) block, covering RSA, EC and
+// Ed25519 public keys alike.
+func parsePublicKeyPEM(pemData []byte) (crypto.PublicKey, error) {
 	block, _ := pem.Decode(pemData)
 	if block == nil {
 		return nil, errors.New(ErrMsgPrivKeyNotPEMEncoded)
 	}
-	// check if it is a RSA PRIVATE KEY
-	if got, want := block.Type, "RSA PRIVATE KEY"; got != want {
-		return nil, errors.Errorf(
-			"unknown server private key type; got: %s, want: %s", got, want)
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func getSigningKey(privKeyPath string) (crypto.Signer, error) {
+	pemData, err := ioutil.ReadFile(privKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrMsgPrivKeyReadFailed)
 	}
-	// return parsed key
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	return parsePrivateKeyPEM(pemData)
 }
 
 // Generates token Id - actually token Id is a UUID v4
@@ -141,15 +915,83 @@ func generateTokenId() string {
 	return uuid.NewV4().String()
 }
 
-func NewJWTAgent(c JWTAgentConfig) (*JWTAgent, error) {
-	// get RSA private key structure from pem key file
-	priv, err := getRSAPrivKey(c.ServerPrivKeyPath)
+// keyThumbprint derives a stable kid for a key, so that the same key
+// always maps to the same kid across restarts and rotations.
+func keyThumbprint(pub crypto.PublicKey) (string, error) {
+	jwk := jose.JSONWebKey{Key: pub}
+	thumb, err := jwk.Thumbprint(jose.Sha256)
+	if err != nil {
+		return "", err
+	}
+	return jose.Base64UrlEncode(thumb), nil
+}
+
+// StaticKeyStore is a KeyStore backed by a single signing key loaded
+// once from a PEM file on disk. It ignores tenancy - every call returns
+// the same key - and exists for deployments that don't use the
+// MongoDB-backed per-tenant keys, e.g. plain open-source installs.
+type StaticKeyStore struct {
+	key *model.Key
+}
+
+// NewStaticKeyStore loads privKeyPath and wraps it as a single-key,
+// always-active KeyStore signing with alg.
+func NewStaticKeyStore(privKeyPath string, alg Algorithm) (*StaticKeyStore, error) {
+	signer, err := getSigningKey(privKeyPath)
 	if err != nil {
 		return nil, err
 	}
-	return &JWTAgent{
-		privKey:    priv,
-		issuer:     c.Issuer,
-		expTimeout: c.ExpirationTimeout,
+
+	kid, err := keyThumbprint(signer.Public())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute kid for server private key")
+	}
+
+	pemData, err := ioutil.ReadFile(privKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, ErrMsgPrivKeyReadFailed)
+	}
+
+	return &StaticKeyStore{
+		key: &model.Key{
+			Kid:        kid,
+			Alg:        string(alg),
+			PrivatePEM: string(pemData),
+			Active:     true,
+			NotBefore:  time.Now(),
+		},
 	}, nil
 }
+
+func (s *StaticKeyStore) GetActiveSigningKey(ctx context.Context) (*model.Key, error) {
+	return s.key, nil
+}
+
+func (s *StaticKeyStore) GetVerificationKey(ctx context.Context, kid string) (*model.Key, error) {
+	if kid != s.key.Kid {
+		return nil, errors.New(ErrMsgUnknownSigningKey + ": " + kid)
+	}
+	return s.key, nil
+}
+
+func (s *StaticKeyStore) GetAllVerificationKeys(ctx context.Context) ([]*model.Key, error) {
+	return []*model.Key{s.key}, nil
+}
+
+func (s *StaticKeyStore) RotateSigningKey(ctx context.Context, key *model.Key) error {
+	return errors.New("StaticKeyStore does not support key rotation")
+}
+
+func NewJWTAgent(c JWTAgentConfig) (*JWTAgent, error) {
+	alg := c.Algorithm
+	if alg == "" {
+		alg = RS256
+	}
+
+	keys, err := NewStaticKeyStore(c.ServerPrivKeyPath, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJWTAgentWithKeyStore(keys, nil, c.Issuer, c.ExpirationTimeout, c.RefreshExpirationTimeout), nil
+}
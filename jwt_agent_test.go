@@ -0,0 +1,498 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/mendersoftware/deviceauth/model"
+)
+
+// fakeKeyStore is an in-memory KeyStore, scoped per tenant exactly like
+// the MongoDB-backed one, so it can stand in for it in tests that need
+// to exercise tenant isolation without a real database.
+type fakeKeyStore struct {
+	mu       sync.Mutex
+	byTenant map[string]map[string]*model.Key
+	active   map[string]string
+}
+
+func newFakeKeyStore() *fakeKeyStore {
+	return &fakeKeyStore{
+		byTenant: map[string]map[string]*model.Key{},
+		active:   map[string]string{},
+	}
+}
+
+func (s *fakeKeyStore) addKey(tenant string, key *model.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byTenant[tenant] == nil {
+		s.byTenant[tenant] = map[string]*model.Key{}
+	}
+	s.byTenant[tenant][key.Kid] = key
+	if key.Active {
+		s.active[tenant] = key.Kid
+	}
+}
+
+func (s *fakeKeyStore) GetActiveSigningKey(ctx context.Context) (*model.Key, error) {
+	tenant := identity.FromContext(ctx).Tenant
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kid, ok := s.active[tenant]
+	if !ok {
+		return nil, errors.New("no active signing key")
+	}
+	return s.byTenant[tenant][kid], nil
+}
+
+func (s *fakeKeyStore) GetVerificationKey(ctx context.Context, kid string) (*model.Key, error) {
+	tenant := identity.FromContext(ctx).Tenant
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.byTenant[tenant][kid]
+	if !ok {
+		return nil, errors.New(ErrMsgUnknownSigningKey)
+	}
+	return key, nil
+}
+
+func (s *fakeKeyStore) GetAllVerificationKeys(ctx context.Context) ([]*model.Key, error) {
+	tenant := identity.FromContext(ctx).Tenant
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*model.Key
+	for _, key := range s.byTenant[tenant] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *fakeKeyStore) RotateSigningKey(ctx context.Context, newKey *model.Key) error {
+	s.addKey(identity.FromContext(ctx).Tenant, newKey)
+	return nil
+}
+
+// fakeAlreadyRevokedError mirrors store/mongo's alreadyRevokedError, so
+// that fakeRevocationStore can be used to exercise the same "RevokeToken
+// as an atomic already-revoked check" contract jwt_agent.go relies on.
+type fakeAlreadyRevokedError struct{}
+
+func (fakeAlreadyRevokedError) Error() string        { return "token already revoked" }
+func (fakeAlreadyRevokedError) AlreadyRevoked() bool { return true }
+
+// fakeRevocationStore is an in-memory RevocationStore used in place of
+// the MongoDB-backed one.
+type fakeRevocationStore struct {
+	mu            sync.Mutex
+	revokedJti    map[string]bool
+	revokedDevice map[string]bool
+}
+
+func newFakeRevocationStore() *fakeRevocationStore {
+	return &fakeRevocationStore{
+		revokedJti:    map[string]bool{},
+		revokedDevice: map[string]bool{},
+	}
+}
+
+// RevokeToken checks-and-sets revokedJti under the same lock, mirroring
+// the atomicity the real store gets from a unique index on jti.
+func (s *fakeRevocationStore) RevokeToken(ctx context.Context, jti, deviceId string, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revokedJti[jti] {
+		return fakeAlreadyRevokedError{}
+	}
+	s.revokedJti[jti] = true
+	return nil
+}
+
+func (s *fakeRevocationStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revokedJti[jti], nil
+}
+
+func (s *fakeRevocationStore) RevokeDeviceTokens(ctx context.Context, deviceId string, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokedDevice[deviceId] = true
+	return nil
+}
+
+func (s *fakeRevocationStore) IsDeviceRevoked(ctx context.Context, deviceId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revokedDevice[deviceId], nil
+}
+
+// newTestSigningKey generates a fresh key suited to alg (RSA for
+// RS256/RS384/PS256, EC P-256 for ES256, Ed25519 for EdDSA) and wraps it
+// as a model.Key, PEM-encoded exactly the way parsePrivateKeyPEM expects
+// to parse it back, returning the raw signer alongside it for tests
+// that need to forge tokens directly with jose.
+func newTestSigningKey(t *testing.T, alg Algorithm) (*model.Key, crypto.Signer) {
+	t.Helper()
+
+	var signer crypto.Signer
+	var block *pem.Block
+
+	switch alg {
+	case RS256, RS384, PS256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate test RSA key: %v", err)
+		}
+		signer = priv
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	case ES256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate test EC key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			t.Fatalf("failed to marshal test EC key: %v", err)
+		}
+		signer = priv
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case EdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate test Ed25519 key: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			t.Fatalf("failed to marshal test Ed25519 key: %v", err)
+		}
+		signer = priv
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		t.Fatalf("newTestSigningKey: unsupported algorithm %q", alg)
+	}
+
+	kid, err := keyThumbprint(signer.Public())
+	if err != nil {
+		t.Fatalf("failed to derive test kid: %v", err)
+	}
+	return &model.Key{
+		Kid:        kid,
+		Alg:        string(alg),
+		PrivatePEM: string(pem.EncodeToMemory(block)),
+		Active:     true,
+		NotBefore:  time.Now(),
+	}, signer
+}
+
+func newTestAgent(keys KeyStore, revocation RevocationStore) *JWTAgent {
+	return NewJWTAgentWithKeyStore(keys, revocation, "deviceauth", 3600, 0)
+}
+
+func TestJWTAgentGenerateAndValidateToken(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, _ := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, nil)
+	defer agent.Close()
+
+	tok, err := agent.GenerateToken(ctx, "dev1")
+	assert.NoError(t, err)
+
+	jti, err := agent.ValidateToken(ctx, tok.Token)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, jti)
+}
+
+// TestJWTAgentSupportsAllAlgorithms exercises generate/validate for
+// every Algorithm chunk0-2 added support for, not just RS256 - in
+// particular the EC PRIVATE KEY and PKCS8 Ed25519 parsing branches in
+// parsePrivateKeyPEM, and jose.NewSigner actually being able to sign
+// with each one.
+func TestJWTAgentSupportsAllAlgorithms(t *testing.T) {
+	for _, alg := range []Algorithm{RS256, RS384, PS256, ES256, EdDSA} {
+		t.Run(string(alg), func(t *testing.T) {
+			keys := newFakeKeyStore()
+			key, _ := newTestSigningKey(t, alg)
+			ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+			keys.addKey("acme", key)
+
+			agent := newTestAgent(keys, nil)
+			defer agent.Close()
+
+			tok, err := agent.GenerateToken(ctx, "dev1")
+			assert.NoError(t, err)
+
+			jti, err := agent.ValidateToken(ctx, tok.Token)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, jti)
+		})
+	}
+}
+
+// TestJWTAgentRejectsAlgMismatch guards against algorithm-confusion: a
+// token whose header claims a different alg than the one its kid's key
+// is on record for must be rejected, even though the same RSA key can
+// validate both signatures.
+func TestJWTAgentRejectsAlgMismatch(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, priv := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, nil)
+	defer agent.Close()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.PS256, Key: priv},
+		(&jose.SignerOptions{}).WithHeader("kid", key.Kid))
+	assert.NoError(t, err)
+
+	claims := customClaims{
+		Claims: jwt.Claims{
+			Issuer:  "deviceauth",
+			Expiry:  jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Subject: "dev1",
+			ID:      "forged-jti",
+		},
+		Type: tokenTypeAccess,
+	}
+	forged, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.NoError(t, err)
+
+	_, err = agent.ValidateToken(ctx, forged)
+	assert.EqualError(t, err, ErrMsgAlgMismatch)
+}
+
+func TestJWTAgentRejectsRevokedToken(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, _ := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, newFakeRevocationStore())
+	defer agent.Close()
+
+	tok, err := agent.GenerateToken(ctx, "dev1")
+	assert.NoError(t, err)
+
+	jti, err := agent.ValidateToken(ctx, tok.Token)
+	assert.NoError(t, err)
+
+	assert.NoError(t, agent.RevokeToken(ctx, jti))
+
+	_, err = agent.ValidateToken(ctx, tok.Token)
+	assert.Equal(t, ErrTokenRevoked, err)
+}
+
+func TestJWTAgentRejectsDeviceRevokedToken(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, _ := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, newFakeRevocationStore())
+	defer agent.Close()
+
+	tok, err := agent.GenerateToken(ctx, "dev1")
+	assert.NoError(t, err)
+
+	assert.NoError(t, agent.RevokeDeviceTokens(ctx, "dev1"))
+
+	_, err = agent.ValidateToken(ctx, tok.Token)
+	assert.Equal(t, ErrTokenRevoked, err)
+}
+
+// TestJWTAgentRefreshTokenReplayDetected covers both replay-detection
+// paths: the durable RevocationStore, and the in-process LRU fallback
+// used when none is configured.
+func TestJWTAgentRefreshTokenReplayDetected(t *testing.T) {
+	revocationStores := map[string]RevocationStore{
+		"with revocation store": newFakeRevocationStore(),
+		"LRU fallback":          nil,
+	}
+	for name, revocation := range revocationStores {
+		t.Run(name, func(t *testing.T) {
+			keys := newFakeKeyStore()
+			key, _ := newTestSigningKey(t, RS256)
+			ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+			keys.addKey("acme", key)
+
+			agent := newTestAgent(keys, revocation)
+			defer agent.Close()
+
+			pair, err := agent.GenerateTokenPair(ctx, "dev1")
+			assert.NoError(t, err)
+
+			_, _, err = agent.RefreshToken(ctx, pair.RefreshToken.Token)
+			assert.NoError(t, err)
+
+			_, _, err = agent.RefreshToken(ctx, pair.RefreshToken.Token)
+			assert.Equal(t, ErrTokenRevoked, err)
+		})
+	}
+}
+
+// TestJWTAgentRefreshTokenReplayDetectedConcurrently is a regression
+// test for the same-jti replay race: two callers presenting the same
+// stolen refresh token at once must not both be issued a fresh pair.
+// Exactly one RefreshToken call must succeed.
+func TestJWTAgentRefreshTokenReplayDetectedConcurrently(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, _ := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, newFakeRevocationStore())
+	defer agent.Close()
+
+	pair, err := agent.GenerateTokenPair(ctx, "dev1")
+	assert.NoError(t, err)
+
+	const attempts = 10
+	var successes int32
+	var wg sync.WaitGroup
+	wg.Add(attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			defer wg.Done()
+			if _, _, err := agent.RefreshToken(ctx, pair.RefreshToken.Token); err == nil {
+				atomic.AddInt32(&successes, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, successes, "exactly one concurrent replay of the same refresh token should succeed")
+}
+
+// TestJWTAgentRefreshRejectsAccessToken makes sure the typ claim is
+// actually enforced: an access token must not be redeemable through
+// RefreshToken just because it's signed by the same key.
+func TestJWTAgentRefreshRejectsAccessToken(t *testing.T) {
+	keys := newFakeKeyStore()
+	key, _ := newTestSigningKey(t, RS256)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+	keys.addKey("acme", key)
+
+	agent := newTestAgent(keys, nil)
+	defer agent.Close()
+
+	access, err := agent.GenerateToken(ctx, "dev1")
+	assert.NoError(t, err)
+
+	_, _, err = agent.RefreshToken(ctx, access.Token)
+	assert.Error(t, err)
+}
+
+// TestJWTAgentKeyCacheIsScopedPerTenant is a regression test for a key
+// cache that let one tenant's kid collide with another's: tenant B here
+// registers a key under the exact same kid as tenant A's, priming the
+// shared cache for that kid before tenant A's own token is ever
+// validated. If the cache weren't scoped per tenant, tenant A's token
+// would be validated (and rejected, for a signature mismatch) against
+// tenant B's cached key instead of its own.
+func TestJWTAgentKeyCacheIsScopedPerTenant(t *testing.T) {
+	keys := newFakeKeyStore()
+	keyA, _ := newTestSigningKey(t, RS256)
+	keyB, _ := newTestSigningKey(t, RS256)
+	keyB.Kid = keyA.Kid
+
+	ctxA := identity.WithContext(context.Background(), &identity.Identity{Tenant: "tenant-a"})
+	ctxB := identity.WithContext(context.Background(), &identity.Identity{Tenant: "tenant-b"})
+	keys.addKey("tenant-a", keyA)
+	keys.addKey("tenant-b", keyB)
+
+	agent := newTestAgent(keys, nil)
+	defer agent.Close()
+
+	tokA, err := agent.GenerateToken(ctxA, "dev-a")
+	assert.NoError(t, err)
+
+	tokB, err := agent.GenerateTokenPair(ctxB, "dev-b")
+	assert.NoError(t, err)
+	_, err = agent.ValidateToken(ctxB, tokB.Token.Token)
+	assert.NoError(t, err)
+
+	jti, err := agent.ValidateToken(ctxA, tokA.Token)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, jti)
+}
+
+// TestJWTAgentRotateSigningKeyHandlerValidatesAlg guards against an
+// admin-supplied alg that's either unsupported or inconsistent with the
+// private_pem key actually being installed - either would otherwise go
+// unnoticed until the next GenerateToken call failed to build a signer.
+func TestJWTAgentRotateSigningKeyHandlerValidatesAlg(t *testing.T) {
+	rsaKey, _ := newTestSigningKey(t, RS256)
+	ecKey, _ := newTestSigningKey(t, ES256)
+
+	cases := []struct {
+		name       string
+		alg        string
+		privatePEM string
+		wantStatus int
+	}{
+		{"valid RS256", string(RS256), rsaKey.PrivatePEM, http.StatusNoContent},
+		{"valid ES256", string(ES256), ecKey.PrivatePEM, http.StatusNoContent},
+		{"unsupported alg", "HS256", rsaKey.PrivatePEM, http.StatusBadRequest},
+		{"alg/key type mismatch", string(ES256), rsaKey.PrivatePEM, http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys := newFakeKeyStore()
+			ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "acme"})
+			agent := newTestAgent(keys, nil)
+			defer agent.Close()
+
+			body, err := json.Marshal(rotateSigningKeyRequest{
+				Alg:        tc.alg,
+				PrivatePEM: tc.privatePEM,
+			})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)).WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			agent.RotateSigningKeyHandler(rr, req)
+			assert.Equal(t, tc.wantStatus, rr.Code)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package model
+
+import "time"
+
+// Key is a tenant's JWT signing key, as stored in the per-tenant
+// signing_keys collection. Kid doubles as the Mongo document id, so it
+// must be unique within a tenant's database.
+type Key struct {
+	Kid        string    `json:"kid" bson:"_id"`
+	Alg        string    `json:"alg" bson:"alg"`
+	PrivatePEM string    `json:"-" bson:"private_pem"`
+	PublicPEM  string    `json:"public_pem" bson:"public_pem"`
+	NotBefore  time.Time `json:"not_before" bson:"not_before"`
+	NotAfter   time.Time `json:"not_after,omitempty" bson:"not_after,omitempty"`
+	Active     bool      `json:"active" bson:"active"`
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package model
+
+import "time"
+
+// RevokedToken is an entry in the revoked_tokens collection. Jti is set
+// for a single revoked token; a device-wide revocation (e.g. from
+// decommissioning a device) is recorded with an empty Jti instead, so
+// that it can be found by DeviceId alone without knowing every jti the
+// device currently holds. Exp is a point no earlier than the token's own
+// expiry (or, for a device-wide entry, a point far enough out to outlive
+// any token that could still be outstanding) and backs a TTL index, so these records
+// clean themselves up once they can no longer be relevant.
+type RevokedToken struct {
+	Jti       string    `bson:"jti,omitempty"`
+	DeviceId  string    `bson:"device_id"`
+	TenantId  string    `bson:"tenant_id,omitempty"`
+	RevokedAt time.Time `bson:"revoked_at"`
+	Exp       time.Time `bson:"exp"`
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+	"time"
+
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mendersoftware/deviceauth/model"
+)
+
+// DbSigningKeysColl holds the per-tenant JWT signing keys used by
+// JWTAgent. It lives in the tenant's own database, same as DbDevicesColl
+// and DbAuthSetColl.
+const DbSigningKeysColl = "signing_keys"
+
+// GetActiveSigningKey returns the tenant's currently active signing key.
+func (db *DataStoreMongo) GetActiveSigningKey(ctx context.Context) (*model.Key, error) {
+	s := db.session.Copy()
+	defer s.Close()
+
+	var key model.Key
+	err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbSigningKeysColl).
+		Find(bson.M{"active": true}).
+		One(&key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find active signing key")
+	}
+	return &key, nil
+}
+
+// GetVerificationKey looks up a (possibly retired) signing key by kid, so
+// that tokens signed before the most recent rotation can still be
+// validated.
+func (db *DataStoreMongo) GetVerificationKey(ctx context.Context, kid string) (*model.Key, error) {
+	s := db.session.Copy()
+	defer s.Close()
+
+	var key model.Key
+	err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbSigningKeysColl).
+		FindId(kid).
+		One(&key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find signing key")
+	}
+	return &key, nil
+}
+
+// GetAllVerificationKeys returns every signing key on record for the
+// tenant (active and retired), for publishing as a JWKS document.
+func (db *DataStoreMongo) GetAllVerificationKeys(ctx context.Context) ([]*model.Key, error) {
+	s := db.session.Copy()
+	defer s.Close()
+
+	var keys []*model.Key
+	err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbSigningKeysColl).
+		Find(nil).
+		All(&keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find signing keys")
+	}
+	return keys, nil
+}
+
+// RotateSigningKey deactivates the tenant's current active key (its
+// not_after is set to now, so tokens already signed with it remain
+// verifiable only until they naturally expire) and inserts newKey as the
+// new active key.
+func (db *DataStoreMongo) RotateSigningKey(ctx context.Context, newKey *model.Key) error {
+	s := db.session.Copy()
+	defer s.Close()
+
+	c := s.DB(ctxstore.DbFromContext(ctx, DbName)).C(DbSigningKeysColl)
+
+	if _, err := c.UpdateAll(
+		bson.M{"active": true},
+		bson.M{"$set": bson.M{"active": false, "not_after": time.Now()}},
+	); err != nil {
+		return errors.Wrap(err, "failed to deactivate current signing key")
+	}
+
+	newKey.Active = true
+	newKey.NotBefore = time.Now()
+	if err := c.Insert(newKey); err != nil {
+		return errors.Wrap(err, "failed to insert new signing key")
+	}
+	return nil
+}
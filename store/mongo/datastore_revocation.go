@@ -0,0 +1,121 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/mendersoftware/deviceauth/model"
+)
+
+// DbRevokedTokensColl holds jti-based and device-wide token revocation
+// records, same as signing keys, scoped to the tenant's own database.
+const DbRevokedTokensColl = "revoked_tokens"
+
+// alreadyRevokedError is returned by RevokeToken when jti was already on
+// record. It implements the alreadyRevokedError interface jwt_agent.go
+// checks for, so callers like checkAndMarkRefreshUsed can distinguish
+// "someone beat us to revoking this jti" from a genuine write failure.
+type alreadyRevokedError struct{}
+
+func (alreadyRevokedError) Error() string        { return "token already revoked" }
+func (alreadyRevokedError) AlreadyRevoked() bool { return true }
+
+// RevokeToken records jti as revoked until exp (normally the token's own
+// expiry, or a safe upper bound on it). The insert doubles as an atomic
+// "is jti already revoked" check thanks to the unique index on jti
+// (migration_1_7_0): two callers racing to revoke the same jti - e.g. a
+// stolen refresh token replayed concurrently - can't both observe "not
+// yet revoked" the way a separate read-then-write would allow.
+func (db *DataStoreMongo) RevokeToken(ctx context.Context, jti, deviceId string, exp time.Time) error {
+	s := db.session.Copy()
+	defer s.Close()
+
+	doc := model.RevokedToken{
+		Jti:       jti,
+		DeviceId:  deviceId,
+		TenantId:  identity.FromContext(ctx).Tenant,
+		RevokedAt: time.Now(),
+		Exp:       exp,
+	}
+
+	err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbRevokedTokensColl).
+		Insert(doc)
+	if mgo.IsDup(err) {
+		return alreadyRevokedError{}
+	}
+	return errors.Wrap(err, "failed to insert revoked token")
+}
+
+// IsTokenRevoked reports whether jti has been explicitly revoked.
+func (db *DataStoreMongo) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s := db.session.Copy()
+	defer s.Close()
+
+	n, err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbRevokedTokensColl).
+		Find(bson.M{"jti": jti}).
+		Count()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to query revoked token")
+	}
+	return n > 0, nil
+}
+
+// RevokeDeviceTokens records a device-wide revocation, e.g. when a
+// device is decommissioned or rejected, so that every token it currently
+// holds stops validating even though their individual jtis were never
+// recorded.
+func (db *DataStoreMongo) RevokeDeviceTokens(ctx context.Context, deviceId string, exp time.Time) error {
+	s := db.session.Copy()
+	defer s.Close()
+
+	doc := model.RevokedToken{
+		DeviceId:  deviceId,
+		TenantId:  identity.FromContext(ctx).Tenant,
+		RevokedAt: time.Now(),
+		Exp:       exp,
+	}
+
+	err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbRevokedTokensColl).
+		Insert(doc)
+	return errors.Wrap(err, "failed to insert device token revocation")
+}
+
+// IsDeviceRevoked reports whether deviceId has an active device-wide
+// revocation on record.
+func (db *DataStoreMongo) IsDeviceRevoked(ctx context.Context, deviceId string) (bool, error) {
+	s := db.session.Copy()
+	defer s.Close()
+
+	// jti is absent (bson "omitempty") on device-wide entries, so match
+	// on its absence rather than on an empty string.
+	n, err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbRevokedTokensColl).
+		Find(bson.M{"device_id": deviceId, "jti": bson.M{"$exists": false}}).
+		Count()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to query device token revocation")
+	}
+	return n > 0, nil
+}
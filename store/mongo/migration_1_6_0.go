@@ -0,0 +1,53 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// migration_1_6_0 creates the per-tenant signing_keys collection used to
+// hand out per-tenant JWT signing keys, indexed by active so looking up
+// the current signing key doesn't require a collection scan. kid is the
+// Mongo document id (model.Key.Kid is tagged bson:"_id"), so it's
+// already covered by the collection's default _id index - no separate
+// index on a "kid" field is needed, since no document has one.
+type migration_1_6_0 struct {
+	ms  *DataStoreMongo
+	ctx context.Context
+}
+
+func (m *migration_1_6_0) Up(from migrate.Version) error {
+	s := m.ms.session.Copy()
+	defer s.Close()
+
+	c := s.DB(ctxstore.DbFromContext(m.ctx, DbName)).C(DbSigningKeysColl)
+
+	if err := c.EnsureIndex(mgo.Index{
+		Key: []string{"active"},
+	}); err != nil {
+		return errors.Wrap(err, "failed to ensure active index on signing_keys")
+	}
+
+	return nil
+}
+
+func (m *migration_1_6_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 6, 0)
+}
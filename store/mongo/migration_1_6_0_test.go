@@ -0,0 +1,74 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceauth/model"
+)
+
+func TestMigration_1_6_0(t *testing.T) {
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "foo",
+	})
+	db.Wipe()
+	db := NewDataStoreMongoWithSession(db.Session())
+	s := db.session
+
+	mig160 := migration_1_6_0{
+		ms:  db,
+		ctx: ctx,
+	}
+	err := mig160.Up(migrate.MakeVersion(1, 6, 0))
+	assert.NoError(t, err)
+
+	indexes, err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbSigningKeysColl).Indexes()
+	assert.NoError(t, err)
+
+	var haveActive bool
+	for _, idx := range indexes {
+		if len(idx.Key) == 1 && idx.Key[0] == "active" {
+			haveActive = true
+		}
+	}
+	assert.True(t, haveActive, "expected an index on active")
+
+	key := &model.Key{
+		Kid:        "test-kid",
+		Alg:        "RS256",
+		PrivatePEM: "private",
+		PublicPEM:  "public",
+		Active:     true,
+	}
+	err = db.RotateSigningKey(ctx, key)
+	assert.NoError(t, err)
+
+	byId, err := db.GetVerificationKey(ctx, "test-kid")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-kid", byId.Kid)
+
+	active, err := db.GetActiveSigningKey(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-kid", active.Kid)
+
+	db.session.Close()
+}
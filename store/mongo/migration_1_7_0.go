@@ -0,0 +1,73 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// migration_1_7_0 creates the per-tenant revoked_tokens collection used
+// to enforce jti-based (and device-wide) token revocation. exp carries a
+// TTL index so a revocation record disappears on its own once it can no
+// longer be relevant, instead of accumulating forever. jti is unique
+// (and sparse, since a device-wide revocation has no jti at all) so that
+// inserting a revocation record doubles as an atomic "was this jti
+// already revoked" check - see datastore_revocation.go's RevokeToken.
+type migration_1_7_0 struct {
+	ms  *DataStoreMongo
+	ctx context.Context
+}
+
+func (m *migration_1_7_0) Up(from migrate.Version) error {
+	s := m.ms.session.Copy()
+	defer s.Close()
+
+	c := s.DB(ctxstore.DbFromContext(m.ctx, DbName)).C(DbRevokedTokensColl)
+
+	if err := c.EnsureIndex(mgo.Index{
+		Key:    []string{"jti"},
+		Unique: true,
+		Sparse: true,
+	}); err != nil {
+		return errors.Wrap(err, "failed to ensure jti index on revoked_tokens")
+	}
+
+	if err := c.EnsureIndex(mgo.Index{
+		Key: []string{"device_id"},
+	}); err != nil {
+		return errors.Wrap(err, "failed to ensure device_id index on revoked_tokens")
+	}
+
+	// mgo only emits expireAfterSeconds for a non-zero ExpireAfter, and
+	// rounds anything below one second up to one, so records are removed
+	// about one second after their exp.
+	if err := c.EnsureIndex(mgo.Index{
+		Key:         []string{"exp"},
+		ExpireAfter: time.Second,
+	}); err != nil {
+		return errors.Wrap(err, "failed to ensure exp TTL index on revoked_tokens")
+	}
+
+	return nil
+}
+
+func (m *migration_1_7_0) Version() migrate.Version {
+	return migrate.MakeVersion(1, 7, 0)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	ctxstore "github.com/mendersoftware/go-lib-micro/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigration_1_7_0(t *testing.T) {
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "foo",
+	})
+	db.Wipe()
+	db := NewDataStoreMongoWithSession(db.Session())
+	s := db.session
+
+	mig170 := migration_1_7_0{
+		ms:  db,
+		ctx: ctx,
+	}
+	err := mig170.Up(migrate.MakeVersion(1, 7, 0))
+	assert.NoError(t, err)
+
+	indexes, err := s.DB(ctxstore.DbFromContext(ctx, DbName)).
+		C(DbRevokedTokensColl).Indexes()
+	assert.NoError(t, err)
+
+	var haveJti, haveDeviceId, haveExpTTL bool
+	for _, idx := range indexes {
+		if len(idx.Key) == 1 && idx.Key[0] == "jti" {
+			haveJti = true
+			assert.True(t, idx.Unique)
+		}
+		if len(idx.Key) == 1 && idx.Key[0] == "device_id" {
+			haveDeviceId = true
+		}
+		if len(idx.Key) == 1 && idx.Key[0] == "exp" && idx.ExpireAfter == time.Second {
+			haveExpTTL = true
+		}
+	}
+	assert.True(t, haveJti, "expected a unique index on jti")
+	assert.True(t, haveDeviceId, "expected an index on device_id")
+	assert.True(t, haveExpTTL, "expected a TTL index on exp")
+
+	exp := time.Now().Add(time.Hour)
+
+	revoked, err := db.IsTokenRevoked(ctx, "jti-1")
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+
+	err = db.RevokeToken(ctx, "jti-1", "dev-1", exp)
+	assert.NoError(t, err)
+
+	revoked, err = db.IsTokenRevoked(ctx, "jti-1")
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	// A different jti for the same device must not be affected by the
+	// jti-scoped revocation above.
+	revoked, err = db.IsTokenRevoked(ctx, "jti-2")
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+
+	deviceRevoked, err := db.IsDeviceRevoked(ctx, "dev-2")
+	assert.NoError(t, err)
+	assert.False(t, deviceRevoked)
+
+	err = db.RevokeDeviceTokens(ctx, "dev-2", exp)
+	assert.NoError(t, err)
+
+	deviceRevoked, err = db.IsDeviceRevoked(ctx, "dev-2")
+	assert.NoError(t, err)
+	assert.True(t, deviceRevoked)
+
+	// The jti-scoped revocation above must not register as a device-wide
+	// one - exercises the jti: {"$exists": false} filter in
+	// IsDeviceRevoked actually excluding jti-bearing entries.
+	deviceRevoked, err = db.IsDeviceRevoked(ctx, "dev-1")
+	assert.NoError(t, err)
+	assert.False(t, deviceRevoked)
+
+	db.session.Close()
+}